@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenTTL is how long a token issued by /login stays valid.
+const tokenTTL = 24 * time.Hour
+
+// Identity is who a Client is, once its token has been verified. The hub
+// and everything downstream of it trusts this instead of whatever
+// Username/Email a client puts in a message.
+type Identity struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+// claims is the JWT payload signed by /login and verified on upgrade.
+type claims struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+// signToken issues a JWT asserting identity, signed with secret.
+func signToken(secret []byte, identity Identity) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Username: identity.Username,
+		Email:    identity.Email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(tokenTTL)),
+		},
+	})
+	return token.SignedString(secret)
+}
+
+// verifyToken checks tokenString's signature and expiry and returns the
+// Identity it asserts.
+func verifyToken(secret []byte, tokenString string) (Identity, error) {
+	parsed, err := jwt.ParseWithClaims(tokenString, &claims{}, func(t *jwt.Token) (any, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
+	if err != nil {
+		return Identity{}, err
+	}
+
+	c := parsed.Claims.(*claims)
+	return Identity{Username: c.Username, Email: c.Email}, nil
+}
+
+// loginRequest is the POST /login body: an account's credentials, plus the
+// Email a successful login's token will assert alongside Username.
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+// CredentialStore looks up the bcrypt hash of an account's password, so
+// loginHandler can verify a login instead of minting a token for whatever
+// username a client claims.
+type CredentialStore interface {
+	// PasswordHash returns the bcrypt hash of username's password, and
+	// whether that account exists at all.
+	PasswordHash(username string) (hash []byte, ok bool)
+}
+
+// loginHandler verifies the POSTed credentials against credentials and, on
+// success, issues a token asserting that username (and whatever email it
+// was also sent) for the rest of the server to trust.
+func loginHandler(secret []byte, credentials CredentialStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req loginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Username == "" {
+			http.Error(w, "username is required", http.StatusBadRequest)
+			return
+		}
+
+		hash, ok := credentials.PasswordHash(req.Username)
+		if !ok || bcrypt.CompareHashAndPassword(hash, []byte(req.Password)) != nil {
+			http.Error(w, "invalid username or password", http.StatusUnauthorized)
+			return
+		}
+
+		token, err := signToken(secret, Identity{Username: req.Username, Email: req.Email})
+		if err != nil {
+			log.Printf("signing token: %v", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"token": token})
+	}
+}
+
+// tokenFromRequest pulls the bearer token out of a WebSocket upgrade
+// request's ?token= query parameter - the only transport browsers can use,
+// since they can't set arbitrary headers on a WebSocket handshake. Sending
+// it as a Sec-WebSocket-Protocol value instead looks appealing for the same
+// reason, but the upgrader doesn't negotiate a subprotocol (Subprotocols is
+// unset and Upgrade's responseHeader is nil), so a browser that offered one
+// would fail the handshake per RFC 6455 section 4.1 the moment the server's
+// response didn't echo it back.
+func tokenFromRequest(r *http.Request) string {
+	return r.URL.Query().Get("token")
+}
@@ -0,0 +1,54 @@
+package main
+
+import "context"
+
+// RoomMessage is a single chat message bound for delivery in a room,
+// received back off a Backplane regardless of which server instance
+// originally published it.
+type RoomMessage struct {
+	Room string
+	Data []byte
+}
+
+// Backplane lets multiple server instances behind a load balancer share
+// broadcast state. Publish is called once per outgoing room message;
+// Subscribe is read continuously and fed into the local Hub so every
+// instance - including the one that published - delivers to its own
+// locally connected clients.
+type Backplane interface {
+	Publish(room string, data []byte) error
+	Subscribe(ctx context.Context) <-chan RoomMessage
+}
+
+// memoryBackplane is the default, single-node Backplane: Publish writes
+// straight into the channel Subscribe reads from, so a lone instance keeps
+// behaving exactly as it did before the backplane existed.
+type memoryBackplane struct {
+	messages chan RoomMessage
+}
+
+// NewMemoryBackplane returns a Backplane with no external dependency,
+// suitable for local development, tests, and single-instance deployments.
+func NewMemoryBackplane() Backplane {
+	return &memoryBackplane{
+		messages: make(chan RoomMessage, 256),
+	}
+}
+
+func (b *memoryBackplane) Publish(room string, data []byte) error {
+	b.messages <- RoomMessage{Room: room, Data: data}
+	return nil
+}
+
+func (b *memoryBackplane) Subscribe(ctx context.Context) <-chan RoomMessage {
+	return b.messages
+}
+
+// newBackplane returns a RedisBackplane when redisURL is non-empty, or the
+// in-memory Backplane otherwise.
+func newBackplane(redisURL string) (Backplane, error) {
+	if redisURL == "" {
+		return NewMemoryBackplane(), nil
+	}
+	return NewRedisBackplane(redisURL)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/time/rate"
+)
+
+// messageRateLimit and messageBurst bound how fast a single client can feed
+// messages into readPump, so one connection can't flood every room it's in.
+const (
+	messageRateLimit rate.Limit = 5
+	messageBurst                = 10
+)
+
+// Time allowed to write a message to the peer.
+const writeWait = 10 * time.Second
+
+// Time allowed to read the next pong message from the peer.
+const pongWait = 60 * time.Second
+
+// Send pings to the peer with this period. Must be less than pongWait.
+const pingPeriod = (pongWait * 9) / 10
+
+// Maximum message size allowed from the peer.
+const maxMessageSize = 8192
+
+// Client is a middleman between the websocket connection and the Hub.
+//
+// Every connected socket gets its own Client, and its own readPump/writePump
+// goroutines. The hub never touches the *websocket.Conn directly - it only
+// ever writes to Client.send - so the connection itself is only ever used by
+// this client's own goroutines.
+type Client struct {
+	hub *Hub
+
+	// The websocket connection.
+	conn *websocket.Conn
+
+	// Buffered channel of outbound messages. writePump is the only reader,
+	// and anyone wanting to deliver a message to this client writes to it
+	// instead of calling conn.WriteJSON directly.
+	send chan []byte
+
+	// username and email are this client's authenticated identity, set once
+	// from handleConnections before readPump/writePump start and never
+	// changed afterwards. Every outgoing message has its Username/Email
+	// overridden from these instead of trusting what the client sent.
+	username string
+	email    string
+
+	// rooms this client has joined. Only readPump's own goroutine ever
+	// mutates this map, so joinRoom/leaveRoom need no locking.
+	rooms map[string]*Room
+
+	// roomOrder records the names in rooms in the order they were joined,
+	// most-recently-joined last, so defaultRoom can name the right one
+	// instead of relying on map iteration order (which Go randomizes).
+	// Mutated alongside rooms, by the same goroutine.
+	roomOrder []string
+
+	// limiter caps how many messages per second this client's readPump will
+	// accept, to keep one connection from spamming every room it's in.
+	limiter *rate.Limiter
+
+	// lastTyping is when this client's last "typing" message was forwarded,
+	// so readPump can debounce a fast typist down to one rebroadcast every
+	// typingDebounce.
+	lastTyping time.Time
+}
+
+// typingDebounce is the minimum gap between two "typing" events from the
+// same client that the hub will forward to a room.
+const typingDebounce = 3 * time.Second
+
+// NewClient wraps an upgraded websocket connection, authenticated as
+// identity, for use with the hub.
+func NewClient(hub *Hub, conn *websocket.Conn, identity Identity) *Client {
+	return &Client{
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan []byte, 256),
+		rooms:    make(map[string]*Room),
+		username: identity.Username,
+		email:    identity.Email,
+		limiter:  rate.NewLimiter(messageRateLimit, messageBurst),
+	}
+}
+
+// joinRoom sends the client recent history for room, then adds it to room,
+// lazily creating it via the hub's RoomManager if needed. Only ever called
+// from the client's own readPump goroutine, or from handleConnections
+// before readPump has started.
+func (c *Client) joinRoom(name string) {
+	if _, ok := c.rooms[name]; ok {
+		return
+	}
+	// History is fetched before the client is added to the room's live
+	// client set, not after, so a message can't land in both: the replay
+	// snapshot and the room's own forward path would otherwise both
+	// include anything appended in between, double-delivering it. A
+	// message that lands in the gap between this query and the join
+	// taking effect is simply missed rather than duplicated - the client
+	// can always page GET /rooms/{room}/history to catch up.
+	c.sendHistory(name)
+
+	for {
+		room := c.hub.rooms.GetOrCreate(name)
+		select {
+		case room.join <- c:
+			c.rooms[name] = room
+			c.roomOrder = append(c.roomOrder, name)
+			return
+		case <-room.closed:
+			// GetOrCreate handed us a room that tore itself down before our
+			// join reached it - nothing will ever read from room.join again.
+			// Retry so the manager creates a fresh one in its place.
+		}
+	}
+}
+
+// sendHistory pushes room's recent history straight to this client's send
+// channel.
+func (c *Client) sendHistory(room string) {
+	history, err := c.hub.store.Recent(room, historyReplaySize)
+	if err != nil {
+		log.Printf("history lookup for room %q: %v", room, err)
+		return
+	}
+	for _, msg := range history {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		select {
+		case c.send <- data:
+		default:
+		}
+	}
+}
+
+// leaveRoom removes the client from room, if it had joined it. Only called
+// from the client's own readPump goroutine.
+func (c *Client) leaveRoom(name string) {
+	room, ok := c.rooms[name]
+	if !ok {
+		return
+	}
+	room.leave <- c
+	delete(c.rooms, name)
+	for i, joined := range c.roomOrder {
+		if joined == name {
+			c.roomOrder = append(c.roomOrder[:i], c.roomOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// readPump pumps messages from the websocket connection to the hub.
+//
+// The application runs readPump in a per-connection goroutine. readPump
+// ensures there is at most one reader on a connection by executing all
+// reads from this goroutine.
+func (c *Client) readPump() {
+	defer func() {
+		for name := range c.rooms {
+			c.leaveRoom(name)
+		}
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		var msg Message
+		err := c.conn.ReadJSON(&msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			break
+		}
+
+		if !c.limiter.Allow() {
+			continue
+		}
+
+		msg.Username = c.username
+		msg.Email = c.email
+
+		switch msg.Type {
+		case "join":
+			c.joinRoom(msg.Room)
+		case "leave":
+			c.leaveRoom(msg.Room)
+		case "typing":
+			if time.Since(c.lastTyping) < typingDebounce {
+				continue
+			}
+			c.lastTyping = time.Now()
+			c.routeToRoom(msg)
+		default:
+			c.routeToRoom(msg)
+		}
+	}
+}
+
+// routeToRoom defaults msg.Room if unset and hands it to the hub.
+func (c *Client) routeToRoom(msg Message) {
+	if msg.Room == "" {
+		msg.Room = c.defaultRoom()
+	}
+	c.hub.route(msg)
+}
+
+// defaultRoom is the room an un-addressed chat message is sent to: the one
+// the client joined most recently, or the hub-wide default if it hasn't
+// joined any room yet.
+func (c *Client) defaultRoom() string {
+	if n := len(c.roomOrder); n > 0 {
+		return c.roomOrder[n-1]
+	}
+	return defaultRoom
+}
+
+// writePump pumps messages from the hub to the websocket connection.
+//
+// A goroutine running writePump is started for each connection. The
+// application ensures that there is at most one writer to a connection by
+// executing all writes from this goroutine.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("error: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
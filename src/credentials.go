@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StaticCredentialStore is a fixed roster of accounts, keyed by username,
+// each holding the bcrypt hash of that account's password. It satisfies
+// CredentialStore and is enough for a small, fixed set of users configured
+// once at startup rather than managed through any admin surface.
+type StaticCredentialStore map[string][]byte
+
+// PasswordHash implements CredentialStore.
+func (s StaticCredentialStore) PasswordHash(username string) (hash []byte, ok bool) {
+	hash, ok = s[username]
+	return hash, ok
+}
+
+// parseStaticCredentials parses the ACCOUNTS environment variable: a
+// comma-separated list of "username:bcryptHash" pairs, one per account.
+func parseStaticCredentials(s string) (StaticCredentialStore, error) {
+	accounts := make(StaticCredentialStore)
+	if s == "" {
+		return accounts, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		username, hash, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid account %q, want username:bcryptHash", pair)
+		}
+		accounts[username] = []byte(hash)
+	}
+	return accounts, nil
+}
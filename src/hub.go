@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultRoom is where a client lands if it doesn't ask to join anything in
+// particular.
+const defaultRoom = "general"
+
+// dmTopicPrefix namespaces the backplane topic a direct message to a given
+// username is published under, so the same Backplane used for room
+// broadcast also carries 1:1 chat to whichever instance that username is
+// actually connected to.
+const dmTopicPrefix = "dm:"
+
+// dmTopic returns the backplane topic a direct message to username is
+// published on.
+func dmTopic(username string) string {
+	return dmTopicPrefix + username
+}
+
+// identifyRequest associates a client with the username it last spoke as, so
+// the hub can route direct messages by username.
+type identifyRequest struct {
+	client   *Client
+	username string
+}
+
+// Hub maintains the set of active clients and routes messages to them,
+// either by fanning a message out to a Room or delivering it directly to a
+// named user.
+//
+// All reads and writes of the clients/usernames maps happen on the single
+// goroutine started by run(), so no locking is required: register,
+// unregister, identify and broadcast are the only way in or out of them.
+type Hub struct {
+	// Registered clients.
+	clients map[*Client]bool
+
+	// Clients indexed by the username they last identified as, so a
+	// Message.To can be delivered without a room broadcast.
+	usernames map[string]map[*Client]bool
+
+	rooms *RoomManager
+
+	// Inbound messages to route, either to a room or directly to a user.
+	broadcast chan Message
+
+	// Register requests from the clients.
+	register chan *Client
+
+	// Unregister requests from clients.
+	unregister chan *Client
+
+	// Username claims from clients, keyed off the Username on a message.
+	identify chan identifyRequest
+
+	// backplane is how room messages reach every server instance, not just
+	// this one. Publish happens inline in run(); incoming is fed by a
+	// separate goroutine reading backplane.Subscribe.
+	backplane Backplane
+	incoming  chan RoomMessage
+
+	// store persists every room message so it can be replayed to clients
+	// that join later. It's also the source of truth for message IDs - see
+	// MessageStore.Append - so that two server instances sharing a backplane
+	// never hand out the same (room, ID) pair.
+	store MessageStore
+
+	// instanceID identifies this process among every instance sharing a
+	// backplane, so a presence update published by this instance's own
+	// rooms can be told apart from one relayed back from another instance.
+	instanceID string
+}
+
+// NewHub creates a Hub using backplane to share room broadcasts across
+// server instances and store to persist them. Call run() in its own
+// goroutine before accepting connections, after starting a goroutine
+// pumping backplane.Subscribe into the Hub via relayIncoming.
+func NewHub(backplane Backplane, store MessageStore) *Hub {
+	instanceID := newInstanceID()
+	return &Hub{
+		broadcast:  make(chan Message),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		identify:   make(chan identifyRequest),
+		clients:    make(map[*Client]bool),
+		usernames:  make(map[string]map[*Client]bool),
+		rooms:      NewRoomManager(backplane, instanceID),
+		backplane:  backplane,
+		incoming:   make(chan RoomMessage, 256),
+		store:      store,
+		instanceID: instanceID,
+	}
+}
+
+// newInstanceID returns a short random identifier for this process, used to
+// tell this instance's own presence publishes apart from another
+// instance's once they're relayed back through the backplane.
+func newInstanceID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// The OS entropy source failing isn't worth crashing the process
+		// over - every instance just ends up with the same ID, which only
+		// degrades presence merging rather than anything user-facing.
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// relayIncoming pumps the backplane's subscription into the hub so that a
+// room message published by any instance - including this one - reaches
+// this instance's locally connected clients. Run it in its own goroutine
+// alongside run().
+func (h *Hub) relayIncoming(ctx context.Context) {
+	for rm := range h.backplane.Subscribe(ctx) {
+		h.incoming <- rm
+	}
+}
+
+// route hands a message received from a client off to the hub for
+// delivery. It is safe to call from any goroutine.
+func (h *Hub) route(msg Message) {
+	h.broadcast <- msg
+}
+
+// setUsername records which username a client is currently speaking as, so
+// direct messages addressed to that username reach it. Safe to call from
+// any goroutine.
+func (h *Hub) setUsername(client *Client, username string) {
+	h.identify <- identifyRequest{client: client, username: username}
+}
+
+// run is the hub's event loop. It must only ever be executed by a single
+// goroutine, started once from main.
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+
+		case client := <-h.unregister:
+			h.disconnect(client)
+
+		case req := <-h.identify:
+			if old := req.client.username; old != "" && old != req.username {
+				if set, ok := h.usernames[old]; ok {
+					delete(set, req.client)
+				}
+			}
+			req.client.username = req.username
+			if h.usernames[req.username] == nil {
+				h.usernames[req.username] = make(map[*Client]bool)
+			}
+			h.usernames[req.username][req.client] = true
+
+		case msg := <-h.broadcast:
+			if msg.To != "" {
+				data, err := json.Marshal(msg)
+				if err != nil {
+					continue
+				}
+				// Published rather than delivered straight out of
+				// h.usernames, which only knows about clients connected to
+				// this instance - To's recipient may be on another
+				// instance entirely behind the load balancer. We'll see
+				// our own publish come back through h.incoming the same
+				// way every instance does.
+				if err := h.backplane.Publish(dmTopic(msg.To), data); err != nil {
+					log.Printf("backplane publish: %v", err)
+				}
+				continue
+			}
+
+			room := msg.Room
+			if room == "" {
+				room = defaultRoom
+			}
+			msg.Room = room
+
+			// Only ordinary chat messages get a history ID and get
+			// persisted. Control frames like "typing" are forwarded live
+			// and otherwise left alone.
+			if msg.Type == "" || msg.Type == "chat" {
+				msg.Timestamp = time.Now().UTC()
+
+				stored, err := h.store.Append(room, msg)
+				if err != nil {
+					log.Printf("appending to message store: %v", err)
+				} else {
+					msg = stored
+				}
+			}
+
+			data, err := json.Marshal(msg)
+			if err != nil {
+				continue
+			}
+			if err := h.backplane.Publish(room, data); err != nil {
+				log.Printf("backplane publish: %v", err)
+			}
+
+		case rm := <-h.incoming:
+			if username, ok := strings.CutPrefix(rm.Room, dmTopicPrefix); ok {
+				for client := range h.usernames[username] {
+					trySend(client, rm.Data)
+				}
+				continue
+			}
+			if name, ok := strings.CutPrefix(rm.Room, presenceTopicPrefix); ok {
+				var update presenceUpdate
+				if err := json.Unmarshal(rm.Data, &update); err != nil {
+					continue
+				}
+				// Looked up rather than created: a room with no clients of
+				// ours has nothing to merge a remote roster into, and
+				// creating one just to hold it would leak a goroutine this
+				// instance's own join/leave traffic would never clean up.
+				if room, ok := h.rooms.Lookup(name); ok && update.InstanceID != h.instanceID {
+					room.remotePresence <- update
+				}
+				continue
+			}
+			h.rooms.GetOrCreate(rm.Room).forward <- rm.Data
+		}
+	}
+}
+
+// trySend delivers data to client's buffered send channel without blocking.
+// If the client is too slow to keep up, it is disconnected instead.
+func trySend(client *Client, data []byte) {
+	select {
+	case client.send <- data:
+	default:
+		client.hub.disconnect(client)
+	}
+}
+
+// disconnect removes client from every room it had joined, its username
+// mapping, and the client set, then closes its send channel so writePump
+// knows to stop. It's the one teardown path for a client leaving the hub,
+// whether that's readPump sending on h.unregister after a normal
+// disconnect, or trySend forcing a slow client out mid-broadcast - if a
+// room still held a reference to a client whose send channel we'd already
+// closed, the next broadcast reaching it would panic on a send to a closed
+// channel. Must only run on the hub's own run() goroutine.
+func (h *Hub) disconnect(client *Client) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	if set, ok := h.usernames[client.username]; ok {
+		delete(set, client)
+		if len(set) == 0 {
+			delete(h.usernames, client.username)
+		}
+	}
+	h.rooms.leaveAll(client)
+	close(client.send)
+}
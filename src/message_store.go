@@ -0,0 +1,34 @@
+package main
+
+// historyReplaySize is how many recent messages a newly joined client is
+// sent before it starts receiving live traffic.
+const historyReplaySize = 50
+
+// MessageStore persists chat history so it can be replayed to clients that
+// join a room after messages were already sent, and paged through via the
+// history HTTP endpoint.
+type MessageStore interface {
+	// Append assigns msg the next ID for room, records it, and returns the
+	// stored copy with that ID set. The store is the single source of
+	// truth for ID assignment (scoped to room) so that two server
+	// instances sharing a backplane never hand out the same one twice; the
+	// Hub no longer keeps its own counter. msg.Room and msg.Timestamp are
+	// expected to already be set.
+	Append(room string, msg Message) (Message, error)
+
+	// Recent returns up to the last n messages sent to room, oldest first.
+	Recent(room string, n int) ([]Message, error)
+
+	// Before returns up to limit messages sent to room with an ID less than
+	// beforeID, oldest first. Used to page backwards through history.
+	Before(room string, beforeID uint64, limit int) ([]Message, error)
+}
+
+// newMessageStore returns a PostgresStore when databaseURL is non-empty, or
+// an in-memory ring buffer otherwise.
+func newMessageStore(databaseURL string) (MessageStore, error) {
+	if databaseURL == "" {
+		return NewMemoryStore(historyReplaySize), nil
+	}
+	return NewPostgresStore(databaseURL)
+}
@@ -0,0 +1,73 @@
+package main
+
+import "sync"
+
+// MemoryStore is a simple in-memory, ring-buffer-backed MessageStore. It
+// keeps only the last size messages per room and forgets everything on
+// restart, which makes it a fine default for local development and tests
+// but not for anything that needs durability.
+//
+// It's also inherently single-instance, so an in-process counter is a fine
+// source of message IDs: there's no second instance it could collide with.
+type MemoryStore struct {
+	mu     sync.Mutex
+	size   int
+	byRoom map[string][]Message
+	nextID map[string]uint64
+}
+
+// NewMemoryStore returns a MemoryStore retaining up to size messages per
+// room.
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{
+		size:   size,
+		byRoom: make(map[string][]Message),
+		nextID: make(map[string]uint64),
+	}
+}
+
+func (s *MemoryStore) Append(room string, msg Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID[room]++
+	msg.ID = s.nextID[room]
+
+	buf := append(s.byRoom[room], msg)
+	if len(buf) > s.size {
+		buf = buf[len(buf)-s.size:]
+	}
+	s.byRoom[room] = buf
+	return msg, nil
+}
+
+func (s *MemoryStore) Recent(room string, n int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := s.byRoom[room]
+	if n > len(buf) {
+		n = len(buf)
+	}
+	out := make([]Message, n)
+	copy(out, buf[len(buf)-n:])
+	return out, nil
+}
+
+func (s *MemoryStore) Before(room string, beforeID uint64, limit int) ([]Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := s.byRoom[room]
+	out := make([]Message, 0, limit)
+	for i := len(buf) - 1; i >= 0 && len(out) < limit; i-- {
+		if buf[i].ID < beforeID {
+			out = append(out, buf[i])
+		}
+	}
+	// reverse into oldest-first order, matching Recent.
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return out, nil
+}
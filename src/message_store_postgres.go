@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// PostgresStore persists chat history in a "messages" table, with IDs drawn
+// from a "room_sequences" table instead of the database's own PRIMARY KEY
+// machinery, since an ID has to be assigned and handed back to the caller
+// before the row can be inserted:
+//
+//	CREATE TABLE messages (
+//	    id         BIGINT NOT NULL,
+//	    room       TEXT NOT NULL,
+//	    email      TEXT NOT NULL,
+//	    username   TEXT NOT NULL,
+//	    message    TEXT NOT NULL,
+//	    sent_at    TIMESTAMPTZ NOT NULL,
+//	    PRIMARY KEY (room, id)
+//	);
+//
+//	CREATE TABLE room_sequences (
+//	    room    TEXT NOT NULL PRIMARY KEY,
+//	    next_id BIGINT NOT NULL DEFAULT 1
+//	);
+//
+// Append's upsert against room_sequences is the per-room source of truth
+// for IDs, so any number of server instances sharing this database can
+// append to the same room without ever handing out the same ID twice - a
+// local counter per instance can't make that guarantee.
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore connects to the Postgres instance at databaseURL.
+func NewPostgresStore(databaseURL string) (*PostgresStore, error) {
+	pool, err := pgxpool.New(context.Background(), databaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStore{pool: pool}, nil
+}
+
+func (s *PostgresStore) Append(room string, msg Message) (Message, error) {
+	row := s.pool.QueryRow(context.Background(),
+		`INSERT INTO room_sequences (room, next_id) VALUES ($1, 2)
+		 ON CONFLICT (room) DO UPDATE SET next_id = room_sequences.next_id + 1
+		 RETURNING next_id - 1`,
+		room)
+	if err := row.Scan(&msg.ID); err != nil {
+		return Message{}, err
+	}
+
+	_, err := s.pool.Exec(context.Background(),
+		`INSERT INTO messages (id, room, email, username, message, sent_at)
+		 VALUES ($1, $2, $3, $4, $5, $6)`,
+		msg.ID, room, msg.Email, msg.Username, msg.Message, msg.Timestamp)
+	if err != nil {
+		return Message{}, err
+	}
+	return msg, nil
+}
+
+func (s *PostgresStore) Recent(room string, n int) ([]Message, error) {
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id, email, username, message, sent_at FROM messages
+		 WHERE room = $1 ORDER BY id DESC LIMIT $2`,
+		room, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs, err := scanMessages(rows, room)
+	if err != nil {
+		return nil, err
+	}
+	reverse(msgs)
+	return msgs, nil
+}
+
+func (s *PostgresStore) Before(room string, beforeID uint64, limit int) ([]Message, error) {
+	rows, err := s.pool.Query(context.Background(),
+		`SELECT id, email, username, message, sent_at FROM messages
+		 WHERE room = $1 AND id < $2 ORDER BY id DESC LIMIT $3`,
+		room, beforeID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs, err := scanMessages(rows, room)
+	if err != nil {
+		return nil, err
+	}
+	reverse(msgs)
+	return msgs, nil
+}
+
+// rowScanner is the subset of pgx.Rows scanMessages needs, so it isn't tied
+// to the concrete type pgxpool.Query returns.
+type rowScanner interface {
+	Next() bool
+	Scan(dest ...any) error
+	Err() error
+}
+
+func scanMessages(rows rowScanner, room string) ([]Message, error) {
+	var msgs []Message
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.Email, &msg.Username, &msg.Message, &msg.Timestamp); err != nil {
+			return nil, err
+		}
+		msg.Room = room
+		msgs = append(msgs, msg)
+	}
+	return msgs, rows.Err()
+}
+
+func reverse(msgs []Message) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
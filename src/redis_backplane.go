@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisChannelPrefix namespaces our pub/sub channels so they don't collide
+// with anything else sharing the same Redis instance. The room name is
+// appended after it, e.g. "gochatroom:room:general".
+const redisChannelPrefix = "gochatroom:room:"
+
+// RedisBackplane is a Backplane backed by Redis PUB/SUB, letting several
+// server instances behind a load balancer share broadcast state: a message
+// published by any instance is delivered back to all of them, including the
+// one that published it.
+type RedisBackplane struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+
+	once     sync.Once
+	messages chan RoomMessage
+}
+
+// NewRedisBackplane connects to the Redis instance at redisURL (e.g.
+// "redis://localhost:6379/0") and returns a Backplane on top of it.
+func NewRedisBackplane(redisURL string) (*RedisBackplane, error) {
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+	return &RedisBackplane{
+		client:   client,
+		pubsub:   client.PSubscribe(context.Background(), redisChannelPrefix+"*"),
+		messages: make(chan RoomMessage, 256),
+	}, nil
+}
+
+// Publish sends data to every instance subscribed to room, including this
+// one - Subscribe's channel receives it the same way a remote instance's
+// would.
+func (b *RedisBackplane) Publish(room string, data []byte) error {
+	return b.client.Publish(context.Background(), redisChannelPrefix+room, data).Err()
+}
+
+// Subscribe starts (once) a goroutine relaying the underlying Redis PUB/SUB
+// channel into a RoomMessage channel, and returns it. It stops relaying once
+// ctx is done.
+func (b *RedisBackplane) Subscribe(ctx context.Context) <-chan RoomMessage {
+	b.once.Do(func() {
+		go b.relay(ctx)
+	})
+	return b.messages
+}
+
+func (b *RedisBackplane) relay(ctx context.Context) {
+	defer b.pubsub.Close()
+
+	ch := b.pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			room := strings.TrimPrefix(msg.Channel, redisChannelPrefix)
+			select {
+			case b.messages <- RoomMessage{Room: room, Data: []byte(msg.Payload)}:
+			default:
+				log.Printf("redis backplane: dropping message for room %q, relay channel full", room)
+			}
+		}
+	}
+}
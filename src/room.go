@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// presenceTopicPrefix namespaces the backplane topic a room's local roster
+// is published under, separate from the room's own chat topic, so every
+// other instance hosting the same room can merge it into what it shows its
+// own clients. See Room.broadcastPresence.
+const presenceTopicPrefix = "presence:"
+
+// remotePresenceBuffer sizes Room.remotePresence - see its doc comment.
+const remotePresenceBuffer = 16
+
+// presenceTopic returns the backplane topic a room's presence roster is
+// published on.
+func presenceTopic(room string) string {
+	return presenceTopicPrefix + room
+}
+
+// presenceUpdate is what a Room publishes whenever its own local membership
+// changes, and what it receives back for every other instance hosting the
+// same room.
+type presenceUpdate struct {
+	InstanceID string   `json:"instance_id"`
+	Members    []string `json:"members"`
+}
+
+// Room scopes broadcast to the clients that have joined it. Like the Hub,
+// a Room's client set is only ever touched by its own run() goroutine, so
+// join/leave/forward are the only way in or out of it.
+type Room struct {
+	name    string
+	manager *RoomManager
+
+	clients map[*Client]bool
+
+	// remote holds the most recently published roster from every other
+	// known instance hosting this room, keyed by instanceID, so a member
+	// list can include clients connected elsewhere behind the load
+	// balancer, not just this instance. An instance that disconnects
+	// without ever publishing an empty roster again leaves a stale entry
+	// behind - there's no heartbeat to expire it, so the gap is accepted
+	// rather than built around. A room also starts with no remote entries
+	// at all on creation, so a client joining a room that's already active
+	// on other instances won't see their members until something there
+	// changes and republishes.
+	remote map[string][]string
+
+	join    chan *Client
+	leave   chan *Client
+	forward chan []byte
+
+	// remotePresence delivers another instance's roster for this room,
+	// relayed by the Hub from the backplane. Only run()'s own goroutine
+	// reads or writes remote. Buffered so the Hub's single goroutine
+	// relaying it can't deadlock against this room's own goroutine
+	// publishing a local change to the same backplane at the same time.
+	remotePresence chan presenceUpdate
+
+	// closed is closed by run() right before it returns, so anyone holding
+	// a *Room obtained from the manager before it tore itself down can tell
+	// their send would otherwise block forever. See RoomManager.GetOrCreate.
+	closed chan struct{}
+}
+
+func newRoom(name string, manager *RoomManager) *Room {
+	return &Room{
+		name:           name,
+		manager:        manager,
+		clients:        make(map[*Client]bool),
+		remote:         make(map[string][]string),
+		join:           make(chan *Client),
+		leave:          make(chan *Client),
+		forward:        make(chan []byte),
+		remotePresence: make(chan presenceUpdate, remotePresenceBuffer),
+		closed:         make(chan struct{}),
+	}
+}
+
+// run is the room's event loop and must only ever execute on a single
+// goroutine, started once by the RoomManager when the room is created.
+func (r *Room) run() {
+	for {
+		select {
+		case client := <-r.join:
+			r.clients[client] = true
+			r.broadcastPresence()
+
+		case client := <-r.leave:
+			if _, ok := r.clients[client]; ok {
+				delete(r.clients, client)
+				if len(r.clients) == 0 {
+					close(r.closed)
+					r.manager.remove(r.name)
+					return
+				}
+				r.broadcastPresence()
+			}
+
+		case data := <-r.forward:
+			r.deliver(data)
+
+		case update := <-r.remotePresence:
+			// Only merged and redelivered locally, not republished - this
+			// didn't change anything about this instance's own roster, and
+			// publishing it back out would bounce right back to whichever
+			// instance sent it, which would do the same in turn, forever.
+			r.remote[update.InstanceID] = update.Members
+			r.deliverPresence()
+		}
+	}
+}
+
+// memberNames snapshots the usernames of clients connected to this instance
+// and currently in the room. Only ever called from run()'s own goroutine.
+func (r *Room) memberNames() []string {
+	names := make([]string, 0, len(r.clients))
+	for client := range r.clients {
+		names = append(names, client.username)
+	}
+	return names
+}
+
+// allMembers merges this instance's own memberNames with the most recent
+// roster reported by every other instance hosting the room, so the result
+// reflects everyone in the room across the whole deployment rather than
+// just whoever happens to be connected to this instance.
+func (r *Room) allMembers() []string {
+	members := r.memberNames()
+	for _, names := range r.remote {
+		members = append(members, names...)
+	}
+	return members
+}
+
+// broadcastPresence tells every other instance hosting this room about a
+// local change to its roster, then tells everyone currently in the room,
+// on every instance, who else is here. Only ever called after a local
+// join or leave - see deliverPresence for redelivering a roster that
+// changed on another instance instead.
+func (r *Room) broadcastPresence() {
+	if err := r.publishPresence(); err != nil {
+		log.Printf("publishing presence for room %q: %v", r.name, err)
+	}
+	r.deliverPresence()
+}
+
+// deliverPresence sends everyone currently in the room the merged roster -
+// this instance's own clients plus whatever every other instance last
+// reported. It isn't persisted to history - presence is a snapshot of the
+// moment, not a chat message.
+func (r *Room) deliverPresence() {
+	data, err := json.Marshal(Message{
+		Type:    "presence",
+		Room:    r.name,
+		Members: r.allMembers(),
+	})
+	if err != nil {
+		return
+	}
+	r.deliver(data)
+}
+
+// publishPresence tells every other instance hosting this room who's
+// currently connected to this one, so their own broadcastPresence can
+// merge it in via r.remote. Only this instance's own join/leave traffic
+// would ever tell them otherwise.
+func (r *Room) publishPresence() error {
+	data, err := json.Marshal(presenceUpdate{
+		InstanceID: r.manager.instanceID,
+		Members:    r.memberNames(),
+	})
+	if err != nil {
+		return err
+	}
+	return r.manager.backplane.Publish(presenceTopic(r.name), data)
+}
+
+// deliver fans data out to every client currently in the room.
+func (r *Room) deliver(data []byte) {
+	for client := range r.clients {
+		select {
+		case client.send <- data:
+		default:
+			// Client's buffer is full; drop it from this room rather than
+			// block delivery to the rest of it. The connection itself is
+			// left alone - the hub's own unregister path is what closes
+			// client.send.
+			delete(r.clients, client)
+		}
+	}
+}
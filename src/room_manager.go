@@ -0,0 +1,82 @@
+package main
+
+import "sync"
+
+// RoomManager lazily creates rooms on first use and forgets them again once
+// their last client leaves, so the process doesn't accumulate one goroutine
+// per room name ever mentioned.
+type RoomManager struct {
+	mu    sync.Mutex
+	rooms map[string]*Room
+
+	// backplane and instanceID let a Room publish its own local presence
+	// roster so every other instance hosting the same room can merge it
+	// in. See Room.publishPresence.
+	backplane  Backplane
+	instanceID string
+}
+
+func NewRoomManager(backplane Backplane, instanceID string) *RoomManager {
+	return &RoomManager{
+		rooms:      make(map[string]*Room),
+		backplane:  backplane,
+		instanceID: instanceID,
+	}
+}
+
+// GetOrCreate returns the Room for name, starting its run() goroutine the
+// first time it's requested.
+func (rm *RoomManager) GetOrCreate(name string) *Room {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	room, ok := rm.rooms[name]
+	if !ok {
+		room = newRoom(name, rm)
+		rm.rooms[name] = room
+		go room.run()
+	}
+	return room
+}
+
+// Lookup returns the Room for name without creating it, and whether it was
+// found. Used for presence updates relayed from another instance: a room
+// this instance has no local clients in has nothing to merge a remote
+// roster into, and creating one just to hold it would leak a goroutine that
+// never has a last local client to trigger its teardown.
+func (rm *RoomManager) Lookup(name string) (*Room, bool) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	room, ok := rm.rooms[name]
+	return room, ok
+}
+
+// remove drops name from the manager. Called by a Room's own run() goroutine
+// once its last client has left.
+func (rm *RoomManager) remove(name string) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	delete(rm.rooms, name)
+}
+
+// leaveAll removes client from every room currently tracked by the manager.
+// Used by Hub.disconnect, which doesn't keep its own record of which rooms a
+// client had joined - each Room's run() goroutine already no-ops a leave for
+// a client it doesn't have, so it's safe to ask all of them.
+func (rm *RoomManager) leaveAll(client *Client) {
+	rm.mu.Lock()
+	rooms := make([]*Room, 0, len(rm.rooms))
+	for _, room := range rm.rooms {
+		rooms = append(rooms, room)
+	}
+	rm.mu.Unlock()
+
+	for _, room := range rooms {
+		select {
+		case room.leave <- client:
+		case <-room.closed:
+			// Tore itself down between our snapshot and this send - it was
+			// already empty, so there's nothing left to remove client from.
+		}
+	}
+}